@@ -78,10 +78,17 @@
 package policy
 
 import (
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/base64"
     "fmt"
     "log"
     "os"
     "strings"
+    "sync"
+    "sync/atomic"
     "time"
 )
 
@@ -261,15 +268,19 @@ type Credential struct {
 }
 
 /**
- * Basic credential matching, by Name match
+ * Basic credential matching, by Name and Value match
+ *
+ * Values are compared in constant time so that the time taken
+ * does not reveal how much of a secret value matched.
  */
 func (c* Credential) Accept(c1* Credential) (bool){
     return strings.Compare(c.Name, c1.Name) == 0 &&
-        strings.Compare(c.Value, c1.Value) == 0
+        subtle.ConstantTimeCompare([]byte(c.Value), []byte(c1.Value)) == 1
 }
 
+/** The value is never printed, so credentials can be logged safely */
 func (c* Credential) String() string {
-    return fmt.Sprintf("Credential: %v/%v", c.Name, c.Value)
+    return fmt.Sprintf("Credential: %v/<redacted>", c.Name)
 }
 
 /** Resource Identifier */
@@ -316,6 +327,19 @@ func (d* Duration) String() string {
     return fmt.Sprintf("%v to %v", d.Start, d.End)
 }
 
+/** A Duration is only valid if it starts before it ends, otherwise it can never be active */
+func (d* Duration) Validate() error {
+    if (!d.Start.Before(d.End)) {
+        return fmt.Errorf("duration %v can never be active", d.String())
+    }
+    return nil
+}
+
+/** Has the duration ended by time when */
+func (d* Duration) Expired(when time.Time) bool {
+    return when.After(d.End)
+}
+
 /** As we refine location support this will become more full featured */
 type Location struct {
     Name string
@@ -333,10 +357,73 @@ func (l* Location) String() string {
     return fmt.Sprintf("%v", l.Name)
 }
 
-/** Contents are used to pass opaque plugin specific information */
+/** 
+ * Contents are used to pass opaque plugin specific information 
+ *
+ * When Encrypted is set, Blob has been sealed with a key only the
+ * plugin identified by PluginId holds (see Seal and Open).
+ */
 type Contents struct {
     PluginId string
     Blob string
+    Encrypted bool
+}
+
+/**
+ * Encrypt Blob with key using AES-GCM (key must be 16, 24 or 32 bytes).
+ * The PluginId is authenticated too, so a sealed blob cannot be moved
+ * to a different plugin. Blob is replaced by the base64 of nonce and
+ * ciphertext.
+ */
+func (c* Contents) Seal(key []byte) error {
+    if (c.Encrypted) {
+        return fmt.Errorf("contents for plugin %v are already encrypted", c.PluginId)
+    }
+    aead, err := contentsCipher(key)
+    if (err != nil) { return err }
+    var nonce = make([]byte, aead.NonceSize())
+    if _, err := rand.Read(nonce); err != nil {
+        return err
+    }
+    var sealed = aead.Seal(nonce, nonce, []byte(c.Blob), []byte(c.PluginId))
+    c.Blob = base64.StdEncoding.EncodeToString(sealed)
+    c.Encrypted = true
+    return nil
+}
+
+/**
+ * Return the Blob decrypted with key. The Contents themselves are left
+ * untouched.
+ *
+ * Contents that are not Encrypted are rejected: a plugin holding a key
+ * expects sealed contents, and Encrypted itself is not authenticated,
+ * so a plain blob may have been swapped in for a sealed one.
+ */
+func (c* Contents) Open(key []byte) (string, error) {
+    if (!c.Encrypted) {
+        return "", fmt.Errorf("contents for plugin %v are not encrypted", c.PluginId)
+    }
+    aead, err := contentsCipher(key)
+    if (err != nil) { return "", err }
+    sealed, err := base64.StdEncoding.DecodeString(c.Blob)
+    if (err != nil) {
+        return "", fmt.Errorf("contents for plugin %v are malformed: %v", c.PluginId, err)
+    }
+    if (len(sealed) < aead.NonceSize()) {
+        return "", fmt.Errorf("contents for plugin %v are truncated", c.PluginId)
+    }
+    var nonce = sealed[:aead.NonceSize()]
+    plain, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], []byte(c.PluginId))
+    if (err != nil) {
+        return "", fmt.Errorf("unable to decrypt contents for plugin %v: %v", c.PluginId, err)
+    }
+    return string(plain), nil
+}
+
+func contentsCipher(key []byte) (cipher.AEAD, error) {
+    block, err := aes.NewCipher(key)
+    if (err != nil) { return nil, err }
+    return cipher.NewGCM(block)
 }
 
 /** Interface used for matching in PolicyBundle */
@@ -366,6 +453,25 @@ type PolicyBase interface {
     String() string
 }
 
+/**
+ * Optional interface for PolicyBase implementations that can be checked
+ * by (p* PolicyBundle) Validate and Expired. Policy and PolicyLine 
+ * implement it, policies that do not are skipped by Validate and are
+ * considered never to expire.
+ */
+type Validator interface {
+
+    /**
+     * check that the policy is well formed and can ever be active
+     */
+    Validate() error
+
+    /**
+     * indicates if the policy can no longer be valid at or after time when
+     */
+    Expired(when time.Time) bool
+}
+
 /** This is the version of the policy schema */
 const PolicyFormatVersion uint64 = 0
 
@@ -443,6 +549,18 @@ func (p* Policy) Match(source* Resource, target* Resource, when time.Time, where
     }
 }
 
+/** A Policy is valid if its Timeline is */
+func (p* Policy) Validate() error {
+    if err := p.Timeline.Validate(); err != nil {
+        return fmt.Errorf("policy %v: %v", p.Description, err)
+    }
+    return nil
+}
+
+func (p* Policy) Expired(when time.Time) bool {
+    return p.Timeline.Expired(when)
+}
+
 func (p* Policy) String() string {
     return fmt.Sprintf("%v:%v:%v\n\ttarget: %v", 
         p.FormatVersion, 
@@ -501,6 +619,42 @@ func (p* PolicyLine) Match(source *Resource, target* Resource, when time.Time, w
     return false, false, false
 }
 
+/** A PolicyLine is valid if it is well formed and all the policies in it are */
+func (p* PolicyLine) Validate() error {
+    if (p.OOperator == NONE) {
+        if (p.PPolicy == nil) { return fmt.Errorf("policy line without a policy") }
+        return p.PPolicy.Validate()
+    }
+    if (p.OOperator != AND && p.OOperator != OR) {
+        return fmt.Errorf("policy line with unknown operator %v", p.OOperator)
+    }
+    if (p.LArg == nil || p.RArg == nil) {
+        return fmt.Errorf("policy line operator without arguments")
+    }
+    if err := p.LArg.Validate(); err != nil { return err }
+    return p.RArg.Validate()
+}
+
+/**
+ * An AND line is invalid as soon as either side is, so it expires with
+ * the first of them. An OR line expires with the last of them.
+ * Lines that Validate rejects can never be valid, so they are expired.
+ */
+func (p* PolicyLine) Expired(when time.Time) bool {
+    if (p.OOperator == NONE) {
+        if (p.PPolicy == nil) { return true }
+        return p.PPolicy.Expired(when)
+    }
+    if (p.LArg == nil || p.RArg == nil) { return true }
+    if (p.OOperator == AND) {
+        return p.LArg.Expired(when) || p.RArg.Expired(when)
+    }
+    if (p.OOperator == OR) {
+        return p.LArg.Expired(when) && p.RArg.Expired(when)
+    }
+    return true
+}
+
 func (p* PolicyLine) String() string {
     if (p.OOperator == NONE) {
         return p.PPolicy.String()
@@ -521,6 +675,65 @@ type PolicyBundle struct {
     Policies []PolicyBase
 }
 
+/**
+ * A BundleMigration upgrades a bundle from one FormatVersion to the next.
+ * It does not need to update FormatVersion itself. It is handed a copy 
+ * of the bundle with its own Policies slice, so policies that change 
+ * must be replaced in that slice rather than modified.
+ */
+type BundleMigration func(p* PolicyBundle) error
+
+var bundleMigrations = map[uint64]BundleMigration{}
+
+/**
+ * Register the migration upgrading bundles from FormatVersion from
+ * to from + 1. This is meant to be called from init functions.
+ * It panics if m is nil or a migration from the same version
+ * has already been registered.
+ */
+func RegisterBundleMigration(from uint64, m BundleMigration) {
+    if (m == nil) {
+        panic(fmt.Sprintf("policy: nil migration from bundle format version %v", from))
+    }
+    if _, dup := bundleMigrations[from]; dup {
+        panic(fmt.Sprintf("policy: migration from bundle format version %v registered twice", from))
+    }
+    bundleMigrations[from] = m
+}
+
+/**
+ * Upgrade a bundle to PolicyBundleFormatVersion by applying the registered
+ * migrations in turn. This should be done whenever a stored bundle is loaded.
+ *
+ * Bundles with a newer FormatVersion than this code supports are rejected.
+ * If any step fails the bundle is left as it was.
+ */
+func (p* PolicyBundle) Migrate() error {
+    return p.migrate(PolicyBundleFormatVersion)
+}
+
+func (p* PolicyBundle) migrate(to uint64) error {
+    if (p.FormatVersion > to) {
+        return fmt.Errorf("bundle format version %v is newer than supported version %v", p.FormatVersion, to)
+    }
+    for v := p.FormatVersion; v < to; v++ {
+        if _, ok := bundleMigrations[v]; !ok {
+            return fmt.Errorf("no migration from bundle format version %v", v)
+        }
+    }
+
+    var work = *p
+    work.Policies = append([]PolicyBase{}, p.Policies...)
+    for work.FormatVersion < to {
+        if err := bundleMigrations[work.FormatVersion](&work); err != nil {
+            return fmt.Errorf("migrating bundle format version %v: %v", work.FormatVersion, err)
+        }
+        work.FormatVersion++
+    }
+    *p = work
+    return nil
+}
+
 /**
  * Check all the policies in a bundle, attempting to see if the request is allowed.
  * A request is allowed only if it has been specifically allowed. Only valid policies, that
@@ -563,3 +776,142 @@ func (p* PolicyBundle) Match(source *Resource, target* Resource, when time.Time,
     }
     return valid, accept, allow
 }
+
+/**
+ * Validate all the policies in a bundle, returning the first error found.
+ *
+ * A bundle where every policy has already expired is valid, but it will
+ * never allow anything. Callers applying a bundle should check Expired
+ * and warn about it.
+ */
+func (p* PolicyBundle) Validate() error {
+    for _, element := range p.Policies {
+        v, ok := element.(Validator)
+        if (!ok) { continue }
+        if err := v.Validate(); err != nil {
+            return fmt.Errorf("bundle %v: %v", p.Description, err)
+        }
+    }
+    return nil
+}
+
+/**
+ * Have all the policies in the bundle expired by time when. An empty bundle,
+ * or one with a policy that is not a Validator, has not.
+ */
+func (p* PolicyBundle) Expired(when time.Time) bool {
+    var found = false
+    for _, element := range p.Policies {
+        if (element == nil) { continue }
+        v, ok := element.(Validator)
+        if (!ok || !v.Expired(when)) { return false }
+        found = true
+    }
+    return found
+}
+
+/**
+ * Decision is the tri-state outcome of evaluating a bundle.
+ *
+ * NotApplicable - no valid policy accepted the request
+ * Deny          - a valid policy accepted and denied the request
+ * Allow         - valid policies accepted the request and none denied it
+ *
+ * Whether NotApplicable is allowed or denied is up to the caller 
+ * (see Allowed), Match itself makes no such choice.
+ */
+type Decision int
+
+const (
+    NotApplicable Decision = 0
+    Deny Decision = 1
+    Allow Decision = 2
+)
+
+/** convert the (valid, accept, allow) result of a Match into a Decision */
+func Decide(valid bool, accept bool, allow bool) Decision {
+    if (!valid || !accept) { return NotApplicable }
+    if (allow) { return Allow }
+    return Deny
+}
+
+/**
+ * Map a decision to a verdict. notApplicable is the verdict to
+ * give when no policy applied to the request.
+ */
+func (d Decision) Allowed(notApplicable bool) bool {
+    if (d == NotApplicable) { return notApplicable }
+    return d == Allow
+}
+
+func (d Decision) String() string {
+    switch d {
+    case NotApplicable:
+        return "NotApplicable"
+    case Deny:
+        return "Deny"
+    case Allow:
+        return "Allow"
+    }
+    return fmt.Sprintf("Decision(%d)", int(d))
+}
+
+/**
+ * Check the bundle like Match does, returning the outcome as a Decision
+ *
+ * see (p* PolicyBundle) Match for inputs
+ */
+func (p* PolicyBundle) Decide(source *Resource, target* Resource, when time.Time, where* Location) Decision {
+    return Decide(p.Match(source, target, when, where))
+}
+
+/**
+ * Parallel version of (p* PolicyBundle) Match, splitting the policies into
+ * one contiguous slice per worker goroutine.
+ *
+ * The result does not depend on the order of evaluation: any denying
+ * policy gives (true, true, false), otherwise allow is set as soon as any
+ * valid policy accepts the request. So as soon as a denying policy is found
+ * the remaining policies are skipped.
+ *
+ * workers < 2 is the same as calling Match.
+ *
+ * see (p* PolicyBundle) Match for inputs and outputs
+ */
+func (p* PolicyBundle) MatchParallel(source *Resource, target* Resource, when time.Time, where* Location, workers int) (bool, bool, bool) {
+    if (workers > len(p.Policies)) { workers = len(p.Policies) }
+    if (workers < 2) { return p.Match(source, target, when, where) }
+
+    var wg sync.WaitGroup
+    var valid, accept, deny atomic.Bool
+    var size = (len(p.Policies) + workers - 1) / workers
+
+    for start := 0; start < len(p.Policies); start += size {
+        var end = start + size
+        if (end > len(p.Policies)) { end = len(p.Policies) }
+        wg.Add(1)
+        go func(policies []PolicyBase) {
+            defer wg.Done()
+            var lValid, lAccept = false, false
+            for _, element := range policies {
+                if (deny.Load()) { return }
+                if (element == nil) { continue }
+                eValid, eAccept, eAllow := element.Match(source, target, when, where)
+                if (!eValid) { continue }
+                lValid = true
+                if (!eAccept) { continue }
+                if (!eAllow) {
+                    deny.Store(true)
+                    return
+                }
+                lAccept = true
+            }
+            if (lValid) { valid.Store(true) }
+            if (lAccept) { accept.Store(true) }
+        }(p.Policies[start:end])
+    }
+    wg.Wait()
+
+    if (deny.Load()) { return true, true, false }
+    return valid.Load(), accept.Load(), accept.Load()
+}
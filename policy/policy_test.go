@@ -17,6 +17,8 @@
 package policy
 
 import (
+    "fmt"
+    "strings"
     "testing"
     "time"
 )
@@ -248,6 +250,17 @@ func TestCredentialMatch(t *testing.T) {
     if (c1.Accept(&c2) != false) {
         t.Errorf("c1 accepts c2")
     }
+    var c3 = Credential{ Name: "n1", Value: "v11" }
+    if (c1.Accept(&c3) != false) {
+        t.Errorf("c1 accepts c3")
+    }
+}
+
+func TestCredentialStringRedactsValue(t *testing.T) {
+    var c1 = Credential{ Name: "n1", Value: "secret" }
+    if (strings.Contains(c1.String(), "secret")) {
+        t.Errorf("credential value leaked: %v", c1.String())
+    }
 }
 
 func TestResourceMatch(t *testing.T) {
@@ -423,3 +436,323 @@ func TestPolicyBundleMatch(t* testing.T) {
     }
 
 }
+
+func TestPolicyBundleMatchParallel(t* testing.T) {
+    var c1 = Credential{ Name: "n1", Value: "v1" }
+    var forever =  Duration{ time.Date(0, 1, 1, 0,0,0,0, time.UTC), time.Date(3000, 1,1, 0,0,0,0, time.UTC) }
+    var expired =  Duration{ time.Date(0, 1, 1, 0,0,0,0, time.UTC), time.Date(1, 1,1, 0,0,0,0, time.UTC) }
+    var everywhere = Location { "everywhere" }
+
+    var tcp80Name = makeIPRule("10.0.0.1").And(makeTCPRule("80")).And(makeServiceRule("/home"))
+    var tcp443Name = makeIPRule("10.0.0.1").And(makeTCPRule("443")).And(makeServiceRule("/home"))
+
+    var tcp80Resource = Resource{ Name: tcp80Name, IdentifiedBy: &c1 }
+    var tcp443Resource = Resource{ Name: tcp443Name, IdentifiedBy: &c1 }
+
+    var tcp80Policy = makePolicy(tcp80Resource, &tcp80Resource, nil,  forever, everywhere)
+    var tcp443Policy = makePolicy(tcp443Resource, &tcp443Resource, nil,  forever, everywhere)
+    var tcp80DenyPolicy = makePolicy(tcp80Resource, nil, &tcp80Resource, forever, everywhere)
+    var tcp80ExpiredPolicy = makePolicy(tcp80Resource, &tcp80Resource, nil, expired, everywhere)
+
+    var policies = []PolicyBase{}
+    for i := 0; i < 50; i++ {
+        policies = append(policies, tcp443Policy, tcp80Policy, tcp80ExpiredPolicy, nil)
+    }
+    var allowPB = PolicyBundle{ Policies: policies }
+    var denyPB = PolicyBundle{ Policies: append(append([]PolicyBase{}, policies...), tcp80DenyPolicy) }
+    var emptyPB = PolicyBundle{ Policies: []PolicyBase{} }
+    var expiredPB = PolicyBundle{ Policies: []PolicyBase{ tcp80ExpiredPolicy } }
+
+    for _, pb := range []*PolicyBundle{ &allowPB, &denyPB, &emptyPB, &expiredPB } {
+        for _, workers := range []int{ 0, 1, 4 } {
+            eValid, eAccept, eAllow := pb.Match(&tcp80Resource, &tcp80Resource, time.Now(), &everywhere)
+            valid, accept, allow := pb.MatchParallel(&tcp80Resource, &tcp80Resource, time.Now(), &everywhere, workers)
+            if (valid != eValid || accept != eAccept || allow != eAllow) {
+                t.Errorf("parallel match with %v workers differs: (e)%v/%v (e)%v/%v (e)%v/%v",
+                    workers, eValid, valid, eAccept, accept, eAllow, allow)
+            }
+        }
+    }
+}
+
+func TestDecision(t* testing.T) {
+    var cases = []struct {
+        valid, accept, allow bool
+        decision Decision
+    }{
+        { false, false, false, NotApplicable },
+        { true, false, false, NotApplicable },
+        { true, true, false, Deny },
+        { true, true, true, Allow },
+    }
+    for _, c := range cases {
+        var d = Decide(c.valid, c.accept, c.allow)
+        if (d != c.decision) {
+            t.Errorf("%v/%v/%v should be %v, got %v", c.valid, c.accept, c.allow, c.decision, d)
+        }
+    }
+
+    if (NotApplicable.Allowed(false) || !NotApplicable.Allowed(true)) {
+        t.Errorf("NotApplicable must map to the given verdict")
+    }
+    if (Deny.Allowed(true) || !Allow.Allowed(false)) {
+        t.Errorf("Deny and Allow must not depend on the NotApplicable verdict")
+    }
+}
+
+func TestPolicyBundleDecide(t* testing.T) {
+    var c1 = Credential{ Name: "n1", Value: "v1" }
+    var forever =  Duration{ time.Date(0, 1, 1, 0,0,0,0, time.UTC), time.Date(3000, 1,1, 0,0,0,0, time.UTC) }
+    var everywhere = Location { "everywhere" }
+
+    var tcp80Resource = Resource{ Name: makeIPRule("10.0.0.1").And(makeTCPRule("80")), IdentifiedBy: &c1 }
+    var tcp443Resource = Resource{ Name: makeIPRule("10.0.0.1").And(makeTCPRule("443")), IdentifiedBy: &c1 }
+
+    var pb = PolicyBundle{ Policies: []PolicyBase{
+        makePolicy(tcp80Resource, &tcp80Resource, nil, forever, everywhere),
+        makePolicy(tcp443Resource, nil, &tcp80Resource, forever, everywhere),
+    } }
+
+    if d := pb.Decide(&tcp80Resource, &tcp80Resource, time.Now(), &everywhere); d != Allow {
+        t.Errorf("tcp80 should be allowed, got %v", d)
+    }
+    if d := pb.Decide(&tcp80Resource, &tcp443Resource, time.Now(), &everywhere); d != Deny {
+        t.Errorf("tcp80 to tcp443 should be denied, got %v", d)
+    }
+    var udpResource = Resource{ Name: makeUDPRule("53"), IdentifiedBy: &c1 }
+    if d := pb.Decide(&udpResource, &udpResource, time.Now(), &everywhere); d != NotApplicable {
+        t.Errorf("udp should not be covered by any policy, got %v", d)
+    }
+}
+
+func TestDurationValidate(t* testing.T) {
+    var forever =  Duration{ time.Date(0, 1, 1, 0,0,0,0, time.UTC), time.Date(3000, 1,1, 0,0,0,0, time.UTC) }
+    var backwards =  Duration{ time.Date(3000, 1, 1, 0,0,0,0, time.UTC), time.Date(0, 1,1, 0,0,0,0, time.UTC) }
+    var instant =  Duration{ time.Date(2000, 1, 1, 0,0,0,0, time.UTC), time.Date(2000, 1,1, 0,0,0,0, time.UTC) }
+
+    if err := forever.Validate(); err != nil {
+        t.Errorf("forever must be valid: %v", err)
+    }
+    if err := backwards.Validate(); err == nil {
+        t.Errorf("a duration ending before it starts must not be valid")
+    }
+    if err := instant.Validate(); err == nil {
+        t.Errorf("a duration ending when it starts must not be valid")
+    }
+    if (forever.Expired(time.Now())) {
+        t.Errorf("forever must not have expired")
+    }
+    if (!forever.Expired(time.Date(4000, 1, 1, 0,0,0,0, time.UTC))) {
+        t.Errorf("forever must have expired by 4000")
+    }
+}
+
+// a PolicyBase that does not implement Validator
+type opaquePolicy struct {}
+
+func (o opaquePolicy) Match(source* Resource, target* Resource, when time.Time, where* Location) (bool, bool, bool) {
+    return false, false, false
+}
+
+func (o opaquePolicy) String() string {
+    return "opaque"
+}
+
+func TestPolicyBundleValidate(t* testing.T) {
+    var c1 = Credential{ Name: "n1", Value: "v1" }
+    var forever =  Duration{ time.Date(0, 1, 1, 0,0,0,0, time.UTC), time.Date(3000, 1,1, 0,0,0,0, time.UTC) }
+    var expired =  Duration{ time.Date(0, 1, 1, 0,0,0,0, time.UTC), time.Date(1, 1,1, 0,0,0,0, time.UTC) }
+    var backwards =  Duration{ time.Date(3000, 1, 1, 0,0,0,0, time.UTC), time.Date(0, 1,1, 0,0,0,0, time.UTC) }
+    var everywhere = Location { "everywhere" }
+
+    var resource = Resource{ Name: makeIPRule("10.0.0.1"), IdentifiedBy: &c1 }
+    var foreverPolicy = makePolicy(resource, &resource, nil, forever, everywhere)
+    var expiredPolicy = makePolicy(resource, &resource, nil, expired, everywhere)
+    var backwardsPolicy = makePolicy(resource, &resource, nil, backwards, everywhere)
+
+    var validPB = PolicyBundle{ Policies: []PolicyBase{ foreverPolicy, expiredPolicy, nil } }
+    if err := validPB.Validate(); err != nil {
+        t.Errorf("validPB must be valid: %v", err)
+    }
+    if (validPB.Expired(time.Now())) {
+        t.Errorf("validPB has a policy that has not expired")
+    }
+
+    var backwardsLine = PolicyLine{ OOperator: OR, LArg: &PolicyLine{ OOperator: NONE, PPolicy: foreverPolicy },
+        RArg: &PolicyLine{ OOperator: NONE, PPolicy: backwardsPolicy } }
+    var invalidPB = PolicyBundle{ Policies: []PolicyBase{ foreverPolicy, &backwardsLine } }
+    if err := invalidPB.Validate(); err == nil {
+        t.Errorf("invalidPB has a policy that can never be active")
+    }
+
+    var brokenLine = PolicyLine{ OOperator: AND, LArg: &PolicyLine{ OOperator: NONE, PPolicy: foreverPolicy } }
+    var brokenPB = PolicyBundle{ Policies: []PolicyBase{ &brokenLine } }
+    if err := brokenPB.Validate(); err == nil {
+        t.Errorf("brokenPB has a policy line missing an argument")
+    }
+    if (!brokenLine.Expired(time.Now())) {
+        t.Errorf("a policy line missing an argument can never be valid")
+    }
+
+    var emptyLine = PolicyLine{ OOperator: NONE }
+    if err := emptyLine.Validate(); err == nil {
+        t.Errorf("a policy line without a policy must not be valid")
+    }
+    if (!emptyLine.Expired(time.Now())) {
+        t.Errorf("a policy line without a policy can never be valid")
+    }
+
+    var unknownLine = PolicyLine{ OOperator: Operator(7), LArg: &PolicyLine{ OOperator: NONE, PPolicy: foreverPolicy },
+        RArg: &PolicyLine{ OOperator: NONE, PPolicy: foreverPolicy } }
+    if err := unknownLine.Validate(); err == nil {
+        t.Errorf("a policy line with an unknown operator must not be valid")
+    }
+    if (!unknownLine.Expired(time.Now())) {
+        t.Errorf("a policy line with an unknown operator can never be valid")
+    }
+
+    var opaquePB = PolicyBundle{ Policies: []PolicyBase{ opaquePolicy{} } }
+    if err := opaquePB.Validate(); err != nil {
+        t.Errorf("policies that are not Validators must be skipped: %v", err)
+    }
+    if (opaquePB.Expired(time.Now())) {
+        t.Errorf("policies that are not Validators never expire")
+    }
+
+    var andLine = PolicyLine{ OOperator: AND, LArg: &PolicyLine{ OOperator: NONE, PPolicy: foreverPolicy },
+        RArg: &PolicyLine{ OOperator: NONE, PPolicy: expiredPolicy } }
+    var expiredPB = PolicyBundle{ Policies: []PolicyBase{ expiredPolicy, &andLine } }
+    if err := expiredPB.Validate(); err != nil {
+        t.Errorf("expiredPB must be valid: %v", err)
+    }
+    if (!expiredPB.Expired(time.Now())) {
+        t.Errorf("all the policies in expiredPB have expired")
+    }
+
+    var emptyPB = PolicyBundle{ Policies: []PolicyBase{} }
+    if (emptyPB.Expired(time.Now())) {
+        t.Errorf("an empty bundle has not expired")
+    }
+}
+
+func TestPolicyBundleMigrate(t* testing.T) {
+    var current = PolicyBundle{ FormatVersion: PolicyBundleFormatVersion }
+    if err := current.Migrate(); err != nil {
+        t.Errorf("current bundle must not need migration: %v", err)
+    }
+
+    var future = PolicyBundle{ FormatVersion: PolicyBundleFormatVersion + 1 }
+    if err := future.Migrate(); err == nil {
+        t.Errorf("bundles newer than supported must be rejected")
+    }
+
+    // pretend that the current format is three versions ahead
+    var from = PolicyBundleFormatVersion
+    var extra = &Policy{ Description: "extra" }
+    RegisterBundleMigration(from, func(p* PolicyBundle) error {
+        p.Description = p.Description + " v1"
+        p.Policies = append(p.Policies, extra)
+        return nil
+    })
+    defer delete(bundleMigrations, from)
+    RegisterBundleMigration(from + 1, func(p* PolicyBundle) error {
+        return fmt.Errorf("broken step")
+    })
+    defer delete(bundleMigrations, from + 1)
+
+    var old = PolicyBundle{ FormatVersion: from, Description: "old", Policies: make([]PolicyBase, 0, 4) }
+    if err := old.migrate(from + 3); err == nil {
+        t.Errorf("migration must fail without a registered step")
+    }
+    if (old.FormatVersion != from || old.Description != "old" || len(old.Policies) != 0) {
+        t.Errorf("a missing step must leave the bundle unchanged: %v %v %v", old.FormatVersion, old.Description, len(old.Policies))
+    }
+
+    RegisterBundleMigration(from + 2, func(p* PolicyBundle) error {
+        p.Description = p.Description + " v3"
+        return nil
+    })
+    defer delete(bundleMigrations, from + 2)
+
+    if err := old.migrate(from + 3); err == nil {
+        t.Errorf("migration must fail on a broken step")
+    }
+    if (old.FormatVersion != from || old.Description != "old" || len(old.Policies) != 0) {
+        t.Errorf("a failed step must leave the bundle unchanged: %v %v %v", old.FormatVersion, old.Description, len(old.Policies))
+    }
+    // the first step appended to a copy, not into the spare capacity of old.Policies
+    if (old.Policies[:1][0] != nil) {
+        t.Errorf("a failed step must not write to the original policies")
+    }
+
+    delete(bundleMigrations, from + 1)
+    RegisterBundleMigration(from + 1, func(p* PolicyBundle) error {
+        p.Description = p.Description + " v2"
+        return nil
+    })
+
+    if err := old.migrate(from + 3); err != nil {
+        t.Errorf("migration must succeed: %v", err)
+    }
+    if (old.FormatVersion != from + 3 || old.Description != "old v1 v2 v3" || len(old.Policies) != 1 || old.Policies[0] != extra) {
+        t.Errorf("all steps must have been applied: %v %v %v", old.FormatVersion, old.Description, len(old.Policies))
+    }
+}
+
+func TestRegisterBundleMigrationDuplicate(t* testing.T) {
+    var from = PolicyBundleFormatVersion
+    RegisterBundleMigration(from, func(p* PolicyBundle) error { return nil })
+    defer delete(bundleMigrations, from)
+
+    defer func() {
+        if recover() == nil {
+            t.Errorf("registering a migration twice must panic")
+        }
+    }()
+    RegisterBundleMigration(from, func(p* PolicyBundle) error { return nil })
+}
+
+func TestContentsSealOpen(t* testing.T) {
+    var key = []byte("0123456789abcdef0123456789abcdef")
+    var otherKey = []byte("fedcba9876543210fedcba9876543210")
+    var c = Contents{ PluginId: "iptables", Blob: "-A INPUT -j DROP" }
+
+    if _, err := c.Open(key); err == nil {
+        t.Errorf("plain contents must not open")
+    }
+
+    if err := c.Seal(key); err != nil {
+        t.Fatalf("unable to seal contents: %v", err)
+    }
+    if (!c.Encrypted || strings.Contains(c.Blob, "DROP")) {
+        t.Errorf("sealed contents must be encrypted: %v", c.Blob)
+    }
+    if err := c.Seal(key); err == nil {
+        t.Errorf("contents must not be sealed twice")
+    }
+
+    blob, err := c.Open(key)
+    if (err != nil || blob != "-A INPUT -j DROP") {
+        t.Errorf("sealed contents must open with the key: %v %v", blob, err)
+    }
+    if _, err := c.Open(otherKey); err == nil {
+        t.Errorf("sealed contents must not open with another key")
+    }
+
+    var downgraded = c
+    downgraded.Blob = "-A INPUT -j ACCEPT"
+    downgraded.Encrypted = false
+    if _, err := downgraded.Open(key); err == nil {
+        t.Errorf("contents swapped for a plain blob must not open")
+    }
+
+    var moved = c
+    moved.PluginId = "nginx"
+    if _, err := moved.Open(key); err == nil {
+        t.Errorf("sealed contents must not open for another plugin")
+    }
+
+    if err := (&Contents{ PluginId: "iptables", Blob: "x" }).Seal([]byte("short")); err == nil {
+        t.Errorf("invalid keys must be rejected")
+    }
+}
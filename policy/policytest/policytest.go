@@ -0,0 +1,193 @@
+/**
+ * PADME Policy test helpers
+ *
+ * Builders for rules, resources, policies and bundles, a random
+ * bundle generator for fuzzing matchers, and golden-file comparison
+ * so tests don't have to hand-write large fixtures.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package policytest
+
+import (
+    "fmt"
+    "math/rand"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/nacx/padme/policy"
+)
+
+/**
+ * When Update is set Golden (re)writes golden files instead of comparing
+ * against them. It defaults to whether POLICYTEST_UPDATE is set, and tests
+ * may also wire it to a flag of their own.
+ */
+var Update = os.Getenv("POLICYTEST_UPDATE") != ""
+
+/** A timeline that covers any sensible time of evaluation */
+var Forever = policy.Duration{
+    Start: time.Date(0, 1, 1, 0, 0, 0, 0, time.UTC),
+    End: time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC),
+}
+
+/** The location used by default in built policies */
+var Everywhere = policy.Location{ Name: "everywhere" }
+
+/** return a single rule RuleSet (operator NONE) */
+func Rule(layer string, ltype string, pattern string) *policy.RuleSet {
+    var rule = policy.Rule{ Layer: layer, LType: ltype, Pattern: pattern }
+    return &policy.RuleSet{ OOperator: policy.NONE, RRule: &rule, LArg: nil, RArg: nil }
+}
+
+/** return a network/ip Layer rule for a given source address */
+func IPRule(srcIp string) *policy.RuleSet {
+    return Rule("network", "ip", "srcIp " + srcIp)
+}
+
+/** return a network/tcp Layer rule for a given destination port */
+func TCPRule(destPort string) *policy.RuleSet {
+    return Rule("network", "tcp", "destPort " + destPort)
+}
+
+/** return a network/udp Layer rule for a given destination port */
+func UDPRule(destPort string) *policy.RuleSet {
+    return Rule("network", "udp", "destPort " + destPort)
+}
+
+/** return a service/www Layer rule for a given service */
+func ServiceRule(service string) *policy.RuleSet {
+    return Rule("service", "www", "service " + service)
+}
+
+/** return a Resource named by name and identified by the given credential */
+func Resource(name *policy.RuleSet, credName string, credValue string) *policy.Resource {
+    var credential = policy.Credential{ Name: credName, Value: credValue }
+    return &policy.Resource{ Name: name, IdentifiedBy: &credential }
+}
+
+/**
+ * return a Policy for target, valid Forever and Everywhere.
+ * allowed and disallowed may be nil.
+ */
+func Policy(description string, target *policy.Resource, allowed *policy.Resource, disallowed *policy.Resource) *policy.Policy {
+    var p = policy.Policy{
+        FormatVersion: policy.PolicyFormatVersion,
+        PolicyVersion: 0,
+        Description: description,
+        Target: *target,
+        Allowed: []*policy.Resource{},
+        Disallowed: []*policy.Resource{},
+        Timeline: Forever,
+        Rate: 0,
+        LLocation: Everywhere,
+        CContents: nil,
+        Signature: "",
+    }
+    if (allowed != nil) { p.Allowed = append(p.Allowed, allowed) }
+    if (disallowed != nil) { p.Disallowed = append(p.Disallowed, disallowed) }
+    return &p
+}
+
+/** return a PolicyBundle holding policies, in order */
+func Bundle(description string, policies ...policy.PolicyBase) *policy.PolicyBundle {
+    return &policy.PolicyBundle{
+        FormatVersion: policy.PolicyBundleFormatVersion,
+        PolicyVersion: 0,
+        Description: description,
+        Policies: policies,
+    }
+}
+
+// the vocabulary random resources are drawn from. It is kept small
+// so that randomly generated requests actually match some policies.
+var randomIPs = []string{ "10.0.0.1", "10.0.0.2", "10.0.0.3" }
+var randomPorts = []string{ "80", "443" }
+var randomServices = []string{ "/home", "/admin" }
+var randomUsers = []string{ "alice", "bob" }
+
+func pick(r *rand.Rand, from []string) string {
+    return from[r.Intn(len(from))]
+}
+
+/**
+ * return a random ip AND tcp AND service Resource. The same rand.Rand
+ * seed always yields the same sequence of resources.
+ */
+func RandomResource(r *rand.Rand) *policy.Resource {
+    var name = IPRule(pick(r, randomIPs)).And(TCPRule(pick(r, randomPorts))).And(ServiceRule(pick(r, randomServices)))
+    return Resource(name, "user", pick(r, randomUsers))
+}
+
+/**
+ * return a bundle of n random policies. Each policy has a random target
+ * and, independently, may allow and may disallow a random source.
+ */
+func RandomBundle(r *rand.Rand, n int) *policy.PolicyBundle {
+    var policies = make([]policy.PolicyBase, 0, n)
+    for i := 0; i < n; i++ {
+        var allowed, disallowed *policy.Resource
+        if (r.Intn(2) == 0) { allowed = RandomResource(r) }
+        if (r.Intn(4) == 0) { disallowed = RandomResource(r) }
+        policies = append(policies, Policy(fmt.Sprintf("random%d", i), RandomResource(r), allowed, disallowed))
+    }
+    return Bundle(fmt.Sprintf("random bundle of %d", n), policies...)
+}
+
+/**
+ * Render a bundle in full for golden comparison. Policy.String() only
+ * covers the target, so allowed and disallowed resources are added here.
+ */
+func BundleString(b *policy.PolicyBundle) string {
+    var out strings.Builder
+    fmt.Fprintf(&out, "%v:%v:%v\n", b.FormatVersion, b.PolicyVersion, b.Description)
+    for _, element := range b.Policies {
+        if (element == nil) { continue }
+        fmt.Fprintf(&out, "%v\n", element.String())
+        p, ok := element.(*policy.Policy)
+        if (!ok) { continue }
+        for _, allowed := range p.Allowed {
+            fmt.Fprintf(&out, "\tallowed: %v\n", allowed.String())
+        }
+        for _, disallowed := range p.Disallowed {
+            fmt.Fprintf(&out, "\tdisallowed: %v\n", disallowed.String())
+        }
+        fmt.Fprintf(&out, "\ttimeline: %v at %v\n", p.Timeline.String(), p.LLocation.String())
+    }
+    return out.String()
+}
+
+/**
+ * Compare got with testdata/<name>.golden, failing t on a difference.
+ * Set Update to (re)write the golden file instead.
+ */
+func Golden(t testing.TB, name string, got string) {
+    t.Helper()
+    var path = filepath.Join("testdata", name + ".golden")
+    if (Update) {
+        if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+            t.Fatalf("unable to update golden file %v: %v", path, err)
+        }
+        return
+    }
+    want, err := os.ReadFile(path)
+    if (err != nil) {
+        t.Fatalf("unable to read golden file %v: %v", path, err)
+    }
+    if (string(want) != got) {
+        t.Errorf("%v does not match golden file:\n--- got\n%v\n--- want\n%v", name, got, string(want))
+    }
+}
@@ -0,0 +1,104 @@
+/**
+ * PADME Policy test helpers tests
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package policytest
+
+import (
+    "flag"
+    "math/rand"
+    "runtime"
+    "testing"
+    "time"
+
+    "github.com/nacx/padme/policy"
+)
+
+func init() {
+    flag.BoolVar(&Update, "update", Update, "update golden files in testdata")
+}
+
+func TestBuiltBundleMatch(t *testing.T) {
+    var home = Resource(IPRule("10.0.0.1").And(TCPRule("80")).And(ServiceRule("/home")), "user", "alice")
+    var admin = Resource(IPRule("10.0.0.1").And(TCPRule("80")).And(ServiceRule("/admin")), "user", "alice")
+    var bundle = Bundle("built", Policy("home", home, home, nil), Policy("admin", admin, nil, home))
+
+    valid, accept, allow := bundle.Match(home, home, time.Now(), &Everywhere)
+    if (valid == false || accept == false || allow == false) {
+        t.Errorf("home should be allowed %v %v %v", valid, accept, allow)
+    }
+
+    valid, accept, allow = bundle.Match(home, admin, time.Now(), &Everywhere)
+    if (valid == false || accept == false || allow == true) {
+        t.Errorf("admin should be denied %v %v %v", valid, accept, allow)
+    }
+}
+
+func TestRandomBundleIsDeterministic(t *testing.T) {
+    var b1 = RandomBundle(rand.New(rand.NewSource(1)), 10)
+    var b2 = RandomBundle(rand.New(rand.NewSource(1)), 10)
+    if (len(b1.Policies) != 10) {
+        t.Errorf("expected 10 policies, got %v", len(b1.Policies))
+    }
+    if (BundleString(b1) != BundleString(b2)) {
+        t.Errorf("the same seed must produce the same bundle")
+    }
+}
+
+func TestRandomBundleMatch(t *testing.T) {
+    var r = rand.New(rand.NewSource(2))
+    var bundle = RandomBundle(r, 20)
+    for i := 0; i < 100; i++ {
+        var source = RandomResource(r)
+        var target = RandomResource(r)
+        valid, accept, allow := bundle.Match(source, target, time.Now(), &Everywhere)
+        if (!valid && (accept || allow)) {
+            t.Errorf("invalid result must neither accept nor allow %v %v %v", valid, accept, allow)
+        }
+        if (!accept && allow) {
+            t.Errorf("a request can only be allowed if accepted %v %v %v", valid, accept, allow)
+        }
+        pValid, pAccept, pAllow := bundle.MatchParallel(source, target, time.Now(), &Everywhere, 4)
+        if (pValid != valid || pAccept != accept || pAllow != allow) {
+            t.Errorf("parallel match differs %v %v %v vs %v %v %v", pValid, pAccept, pAllow, valid, accept, allow)
+        }
+    }
+}
+
+func TestBundleGolden(t *testing.T) {
+    var home = Resource(IPRule("10.0.0.1").And(TCPRule("80").Or(TCPRule("443"))).And(ServiceRule("/home")), "user", "alice")
+    var intruder = Resource(IPRule("10.0.0.9").And(UDPRule("53")), "user", "mallory")
+    var line = policy.PolicyLine{ OOperator: policy.NONE, PPolicy: Policy("line", home, home, nil) }
+    Golden(t, "bundle", BundleString(Bundle("golden", Policy("home", home, home, intruder), &line)))
+}
+
+func benchmarkBundleMatch(b *testing.B, workers int) {
+    var r = rand.New(rand.NewSource(3))
+    var bundle = RandomBundle(r, 10000)
+    // an unrelated request, so that the whole bundle is always evaluated
+    var request = Resource(IPRule("192.168.0.1").And(TCPRule("22")).And(ServiceRule("/ssh")), "user", "eve")
+    var now = time.Now()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        bundle.MatchParallel(request, request, now, &Everywhere, workers)
+    }
+}
+
+func BenchmarkMatch(b *testing.B) {
+    benchmarkBundleMatch(b, 1)
+}
+
+func BenchmarkMatchParallel(b *testing.B) {
+    benchmarkBundleMatch(b, runtime.GOMAXPROCS(0))
+}